@@ -8,31 +8,102 @@ See LICENSE file in the top-level directory.
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// logger is a structured, leveled logger configured from LOG_LEVEL
+// (DEBUG/INFO/WARN/ERROR, default INFO) and LOG_FORMAT (json or text,
+// default text). Log lines about a vplc carry a vplc_instance field so
+// operators can filter the noise from a single failing instance instead of
+// grepping unstructured multi-line output. Lines about a single upstream
+// call (login or API request) also carry url and duration_ms, plus
+// status_code once a response was received; other vplc log lines (such as a
+// failed probe or missing performanceMetrics) do not carry all four fields.
+var logger = newLogger()
+
+func newLogger() *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevelFromEnv("LOG_LEVEL", slog.LevelInfo)}
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	return slog.New(handler)
+}
+
+func logLevelFromEnv(envVar string, def slog.Level) slog.Level {
+	switch strings.ToUpper(os.Getenv(envVar)) {
+	case "DEBUG":
+		return slog.LevelDebug
+	case "INFO":
+		return slog.LevelInfo
+	case "WARN", "WARNING":
+		return slog.LevelWarn
+	case "ERROR":
+		return slog.LevelError
+	default:
+		return def
+	}
+}
+
+// VplcAccess describes one vplc to scrape. CredentialSource selects how
+// UserName/Password are obtained: "inline" (the default, reading UserName/
+// Password directly, for backward compatibility with existing access
+// files), "env" (CredentialRef is "USER_VAR:PASS_VAR"), "file" (CredentialRef
+// is a path to a "user:pass" secret file), "vault" (CredentialRef is a Vault
+// KV v2 path) or "k8s-secret" (CredentialRef is "namespace/secretName").
 type VplcAccess struct {
-	Name     string `json:"name"`
-	LoginUrl string `json:"loginUrl"`
-	ApiUrl   string `json:"apiUrl"`
-	UserName string `json:"user"`
-	Password string `json:"password"`
+	Name             string `json:"name"`
+	LoginUrl         string `json:"loginUrl"`
+	ApiUrl           string `json:"apiUrl"`
+	UserName         string `json:"user,omitempty"`
+	Password         string `json:"password,omitempty"`
+	CredentialSource string `json:"credentialSource,omitempty"`
+	CredentialRef    string `json:"credentialRef,omitempty"`
+}
+
+// credentialProvider resolves the CredentialProvider implementation for
+// this vplc's configured CredentialSource.
+func (v VplcAccess) credentialProvider() (CredentialProvider, error) {
+	switch v.CredentialSource {
+	case "", "inline":
+		return inlineCredentialProvider{user: v.UserName, pass: v.Password}, nil
+	case "env":
+		return envCredentialProvider{ref: v.CredentialRef}, nil
+	case "file":
+		return fileCredentialProvider{path: v.CredentialRef}, nil
+	case "vault":
+		return vaultCredentialProvider{path: v.CredentialRef}, nil
+	case "k8s-secret":
+		return k8sSecretCredentialProvider{ref: v.CredentialRef}, nil
+	default:
+		return nil, fmt.Errorf("unknown credentialSource %q for vplc %s", v.CredentialSource, v.Name)
+	}
 }
 
 type VplcAccessList struct {
@@ -72,72 +143,206 @@ var crbMetricDescs = []metricDesc{
 }
 
 // Metric Registration and Storage
-var crbMetrics = make(map[string]*prometheus.CounterVec)
-var crbGauges = make(map[string]*prometheus.GaugeVec)
+//
+// metricsSet bundles one probe's worth of CRB gauge collectors, registered
+// to their own unshared registry rather than the process-wide default one.
+// Following the multi-target exporter pattern, each /probe request builds a
+// fresh metricsSet: concurrent scrapes of different vplcs never collide over
+// collector registration, and a vplc that stops being probed simply stops
+// appearing instead of lingering on a shared /metrics page. Gauges are a
+// natural fit for this: Set() on a brand-new collector reports the current
+// value correctly regardless of what came before.
+//
+// Counters and histograms/summaries are NOT among metricsSet's prebuilt
+// collectors: Prometheus expects their exposed value to be cumulative
+// across scrapes, which a
+// collector that's discarded at the end of every /probe can't provide by
+// itself. See updateCRBMetrics and the "Histogram and Summary Metrics"
+// section below for how each is kept cumulative instead.
+type metricsSet struct {
+	registry  *prometheus.Registry
+	crbGauges map[string]*prometheus.GaugeVec
+}
+
+func newMetricsSet() *metricsSet {
+	registry := prometheus.NewRegistry()
+	ms := &metricsSet{
+		registry:  registry,
+		crbGauges: make(map[string]*prometheus.GaugeVec),
+	}
 
-func initCRBMetrics() {
 	for _, desc := range crbMetricDescs {
-		switch desc.Type {
-		case counter:
-			crbMetrics[desc.PromName] = prometheus.NewCounterVec(
-				prometheus.CounterOpts{
-					Name: desc.PromName,
-					Help: desc.Help,
-				},
-				[]string{"vplc_instance"},
-			)
-			prometheus.MustRegister(crbMetrics[desc.PromName])
-		case gauge:
-			crbGauges[desc.PromName] = prometheus.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Name: desc.PromName,
-					Help: desc.Help,
-				},
-				[]string{"vplc_instance"},
-			)
-			prometheus.MustRegister(crbGauges[desc.PromName])
+		if desc.Type != gauge {
+			continue
 		}
+		gv := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: desc.PromName,
+				Help: desc.Help,
+			},
+			[]string{"vplc_instance"},
+		)
+		registry.MustRegister(gv)
+		ms.crbGauges[desc.PromName] = gv
 	}
+
+	return ms
 }
 
-// Histogram Metrics
+// Histogram and Summary Metrics
+//
+// The vplc API only reports per-bucket lifetime counts keyed by a
+// human-readable range such as "0.0-1.0ms" or "20.0+ms" (the latter being
+// the overflow bucket), not individual samples. To let histogram_quantile(),
+// rate() and _sum/_count work natively in PromQL, updateHistograms
+// reconstructs per-observation deltas from that snapshot (the increase in
+// each bucket's lifetime count since the previous poll) and feeds them into
+// real prometheus.HistogramVecs at each bucket's midpoint. A companion
+// SummaryVec is populated from the same observations for operators who want
+// precomputed quantiles without relying on histogram_quantile's bucket
+// interpolation.
+//
+// These two HistogramVecs (and their SummaryVec companions) live on the
+// package-level crbRegistry below rather than on a per-probe metricsSet: the
+// delta-replay they're fed with (see observeBucketDeltas) only ever Observe()s
+// the increase since the last poll, so the Vec itself must persist across
+// probes to keep accumulating the full history. A fresh-per-probe Vec would
+// forget everything observed on prior probes the moment that probe's
+// registry was discarded.
 var (
-	writeDurationBuckets = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "write_duration_bucket",
-			Help: "Write duration histogram buckets (cumulative)",
+	crbRegistry             = prometheus.NewRegistry()
+	writeDurationHistogram  *prometheus.HistogramVec
+	cycleExtensionHistogram *prometheus.HistogramVec
+	writeDurationSummary    *prometheus.SummaryVec
+	cycleExtensionSummary   *prometheus.SummaryVec
+)
+
+var (
+	writeDurationBucketsMs      = bucketBoundsMsFromEnv("WRITE_DURATION_BUCKETS_MS", []float64{0.5, 1, 2, 5, 10, 20, 50, 100})
+	cycleExtensionBucketsMs     = bucketBoundsMsFromEnv("CYCLE_EXTENSION_BUCKETS_MS", []float64{0.5, 1, 2, 5, 10, 20, 50, 100})
+	nativeHistogramBucketFactor = nativeBucketFactorFromEnv("NATIVE_HISTOGRAM_BUCKET_FACTOR")
+)
+
+func init() {
+	writeDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:                        "vplc_write_duration_seconds",
+			Help:                        "Write duration per cycle, reconstructed from the vplc API's bucket snapshot",
+			Buckets:                     msToSeconds(writeDurationBucketsMs),
+			NativeHistogramBucketFactor: nativeHistogramBucketFactor,
 		},
-		[]string{"vplc_instance", "le"},
+		[]string{"vplc_instance"},
 	)
-
-	cycleExtensionBuckets = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "cycle_extension_bucket",
-			Help: "Cycle extension histogram buckets (cumulative)",
+	cycleExtensionHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:                        "vplc_cycle_extension_duration_seconds",
+			Help:                        "Cycle extension duration per cycle, reconstructed from the vplc API's bucket snapshot",
+			Buckets:                     msToSeconds(cycleExtensionBucketsMs),
+			NativeHistogramBucketFactor: nativeHistogramBucketFactor,
 		},
-		[]string{"vplc_instance", "le"},
+		[]string{"vplc_instance"},
 	)
-)
+	writeDurationSummary = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "vplc_write_duration_seconds_summary",
+			Help:       "Write duration quantiles per vplc instance",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"vplc_instance"},
+	)
+	cycleExtensionSummary = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "vplc_cycle_extension_duration_seconds_summary",
+			Help:       "Cycle extension duration quantiles per vplc instance",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"vplc_instance"},
+	)
+	crbRegistry.MustRegister(writeDurationHistogram, cycleExtensionHistogram)
+	crbRegistry.MustRegister(writeDurationSummary, cycleExtensionSummary)
+}
 
-func init() {
-	initCRBMetrics()
-	prometheus.MustRegister(cycleExtensionBuckets)
-	prometheus.MustRegister(writeDurationBuckets)
-}
-
-// Helper: parse upper bound from bucket string like "0.0-1.0ms" or "20.0+ms"
-func parseBucketUpperBoundMs(bucket string) float64 {
-	// Matches "0.0-1.0ms" or "20.0+ms"
-	re := regexp.MustCompile(`(\d+(\.\d+)?)(\+)?ms$`)
-	matches := re.FindStringSubmatch(bucket)
-	if len(matches) >= 2 {
-		val, _ := strconv.ParseFloat(matches[1], 64)
-		if matches[3] == "+" {
-			return 1e9 // treat "+" as a very large bucket
+// bucketBoundsMsFromEnv reads a comma-separated list of millisecond bucket
+// boundaries from the named env var, falling back to defaults if unset or
+// unparseable.
+func bucketBoundsMsFromEnv(envVar string, defaults []float64) []float64 {
+	raw := os.Getenv(envVar)
+	if raw == "" {
+		return defaults
+	}
+	parts := strings.Split(raw, ",")
+	bounds := make([]float64, 0, len(parts))
+	for _, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			logger.Warn("invalid bucket boundary, falling back to defaults", "env_var", envVar, "value", p)
+			return defaults
 		}
-		return val
+		bounds = append(bounds, v)
+	}
+	return bounds
+}
+
+func msToSeconds(msValues []float64) []float64 {
+	seconds := make([]float64, len(msValues))
+	for i, v := range msValues {
+		seconds[i] = v / 1000
+	}
+	return seconds
+}
+
+// nativeBucketFactorFromEnv reads NativeHistogramBucketFactor from the named
+// env var. A zero value (the default when unset) leaves native histograms
+// disabled and only the classic buckets above are published.
+func nativeBucketFactorFromEnv(envVar string) float64 {
+	raw := os.Getenv(envVar)
+	if raw == "" {
+		return 0
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		logger.Warn("invalid native histogram bucket factor, native histograms disabled", "env_var", envVar, "value", raw)
+		return 0
+	}
+	return v
+}
+
+// bucketRangeRe matches bucket labels like "0.0-1.0ms" (a closed range) or
+// "20.0+ms" (the open-ended overflow bucket).
+var bucketRangeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)(?:-(\d+(?:\.\d+)?))?(\+)?ms$`)
+
+// parseBucketRangeMs parses a bucket label into its lower and upper bound in
+// milliseconds. The overflow bucket ("20.0+ms") has no upper bound and
+// reports +Inf rather than an arbitrary large sentinel.
+func parseBucketRangeMs(bucket string) (lower, upper float64, ok bool) {
+	m := bucketRangeRe.FindStringSubmatch(bucket)
+	if m == nil {
+		return 0, 0, false
+	}
+	lower, _ = strconv.ParseFloat(m[1], 64)
+	switch {
+	case m[3] == "+":
+		return lower, math.Inf(1), true
+	case m[2] != "":
+		upper, _ = strconv.ParseFloat(m[2], 64)
+		return lower, upper, true
+	default:
+		return lower, lower, true
+	}
+}
+
+// bucketMidpointMs returns the millisecond value to attribute reconstructed
+// observations to. The overflow bucket has no finite upper bound, so
+// observations are attributed to its lower edge instead of an average.
+func bucketMidpointMs(bucket string) float64 {
+	lower, upper, ok := parseBucketRangeMs(bucket)
+	if !ok {
+		return 0
+	}
+	if math.IsInf(upper, 1) {
+		return lower
 	}
-	return 0
+	return (lower + upper) / 2
 }
 
 // Helper: get value from nested map using slash-separated path
@@ -176,37 +381,45 @@ func getNestedValue(data map[string]interface{}, path string) (float64, bool) {
 
 // Main Metric Update Function
 var (
-	previousCounterValues = make(map[string]map[string]float64) // map[promName][vplc_instance]value
-	prevWriteBuckets      = make(map[string]float64)            // key: vplc_instance|le
-	prevCycleBuckets      = make(map[string]float64)            // key: vplc_instance|le
+	prevWriteBucketCounts = make(map[string]float64) // key: vplc_instance|bucket label
+	prevCycleBucketCounts = make(map[string]float64) // key: vplc_instance|bucket label
 	metricsMu             sync.Mutex
 )
 
-func updateCRBMetrics(data map[string]interface{}, vplc_instance string) {
+// updateCRBMetrics populates ms's per-probe gauges and builds a fresh,
+// per-probe CounterVec per counter-type desc, set via Add(v) to the raw
+// lifetime value the vplc API reports rather than a delta against any
+// remembered previous value. That's the correct way to expose a cumulative
+// counter through a collector that's rebuilt from zero every probe: Add(v)
+// on a zero-valued counter just reports v, so the wire value for this scrape
+// is the vplc's true lifetime count, and Prometheus's own rate()/increase()
+// already difference successive raw samples across scrapes rather than
+// relying on our process to have remembered anything in between.
+func updateCRBMetrics(ms *metricsSet, data map[string]interface{}, vplc_instance string) {
 	// v2 api puts all relevant data under performanceMetrics
 	performanceData, ok := data["performanceMetrics"].(map[string]interface{})
 	if !ok {
-		log.Printf("performanceMetrics not found for vplc %s", vplc_instance)
+		logger.Warn("performanceMetrics not found", "vplc_instance", vplc_instance)
 		return
 	}
-	metricsMu.Lock()
-	defer metricsMu.Unlock()
 	for _, desc := range crbMetricDescs {
-		if v, ok := getNestedValue(performanceData, desc.JSONName); ok {
-			switch desc.Type {
-			case counter:
-				if _, exists := previousCounterValues[desc.PromName]; !exists {
-					previousCounterValues[desc.PromName] = make(map[string]float64)
-				}
-				prevValue := previousCounterValues[desc.PromName][vplc_instance]
-				delta := v - prevValue
-				if delta > 0 {
-					crbMetrics[desc.PromName].WithLabelValues(vplc_instance).Add(delta)
-				}
-				previousCounterValues[desc.PromName][vplc_instance] = v
-			case gauge:
-				crbGauges[desc.PromName].WithLabelValues(vplc_instance).Set(v)
-			}
+		v, ok := getNestedValue(performanceData, desc.JSONName)
+		if !ok {
+			continue
+		}
+		switch desc.Type {
+		case counter:
+			cv := prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: desc.PromName,
+					Help: desc.Help,
+				},
+				[]string{"vplc_instance"},
+			)
+			ms.registry.MustRegister(cv)
+			cv.WithLabelValues(vplc_instance).Add(v)
+		case gauge:
+			ms.crbGauges[desc.PromName].WithLabelValues(vplc_instance).Set(v)
 		}
 	}
 }
@@ -214,103 +427,361 @@ func updateCRBMetrics(data map[string]interface{}, vplc_instance string) {
 func updateHistograms(hist Histogram, vplc_instance string) {
 	metricsMu.Lock()
 	defer metricsMu.Unlock()
-	// Sort WriteDurationHistogram by upper bound
-	var sortedWriteKeys []string
-	for k := range hist.WriteDurationHistogram {
-		sortedWriteKeys = append(sortedWriteKeys, k)
-	}
-	sort.Slice(sortedWriteKeys, func(i, j int) bool {
-		return parseBucketUpperBoundMs(sortedWriteKeys[i]) < parseBucketUpperBoundMs(sortedWriteKeys[j])
-	})
-	var cumulative float64
-	for _, k := range sortedWriteKeys {
-		cumulative += float64(hist.WriteDurationHistogram[k])
-		le := strconv.FormatFloat(parseBucketUpperBoundMs(k), 'f', -1, 64)
-		curr := writeDurationBuckets.WithLabelValues(vplc_instance, le)
-		delta := cumulative - getPreviousBucketValue("write", vplc_instance+"|"+le)
-		if delta > 0 {
-			curr.Add(delta)
+	observeBucketDeltas(hist.WriteDurationHistogram, vplc_instance, prevWriteBucketCounts, writeDurationHistogram, writeDurationSummary)
+	observeBucketDeltas(hist.CycleExtensionDurationHistogram, vplc_instance, prevCycleBucketCounts, cycleExtensionHistogram, cycleExtensionSummary)
+}
+
+// observeBucketDeltas reconstructs individual observations from the increase
+// in each bucket's lifetime count since the previous poll and records one
+// Observe() per reconstructed sample at that bucket's midpoint. prevCounts
+// is updated in place regardless of the sign of the delta so a counter
+// reset (e.g. the vplc restarting) re-baselines cleanly instead of
+// reporting a permanently negative delta.
+//
+// The very first sight of a given vplc/bucket pair only seeds prevCounts
+// rather than replaying one Observe() per unit of the bucket's entire
+// lifetime count (as the CRB counters' Add()-based reconstruction already
+// does implicitly, being O(1) regardless of magnitude): a PLC cycling every
+// few ms for weeks can have tens of millions of lifetime observations in a
+// single bucket, and looping that many Observe() calls synchronously under
+// metricsMu would stall every vplc's /probe, not just this one's.
+func observeBucketDeltas(buckets map[string]float64, vplc_instance string, prevCounts map[string]float64, hv *prometheus.HistogramVec, sv *prometheus.SummaryVec) {
+	for bucket, count := range buckets {
+		key := vplc_instance + "|" + bucket
+		prev, seen := prevCounts[key]
+		prevCounts[key] = count
+		if !seen {
+			continue
+		}
+		delta := count - prev
+		if delta <= 0 {
+			continue
+		}
+		midpointSeconds := bucketMidpointMs(bucket) / 1000
+		for i := 0; i < int(delta); i++ {
+			hv.WithLabelValues(vplc_instance).Observe(midpointSeconds)
+			sv.WithLabelValues(vplc_instance).Observe(midpointSeconds)
 		}
-		setPreviousBucketValue("write", vplc_instance+"|"+le, cumulative)
 	}
+}
+
+// Credential Providers
+//
+// Resolving credentials through a CredentialProvider instead of reading
+// VplcAccess.Password directly lets the access file hold a reference
+// (an env var name, a file path, a Vault path, a k8s Secret name) rather
+// than a plaintext secret, and lets that secret be fetched fresh each time a
+// token is obtained instead of held in memory for the process lifetime.
+type CredentialProvider interface {
+	Get(ctx context.Context) (user, pass string, err error)
+}
+
+// inlineCredentialProvider is the default, backward-compatible provider: the
+// plaintext username/password already present in the access file.
+type inlineCredentialProvider struct {
+	user, pass string
+}
 
-	// Sort CycleExtensionDurationHistogram by upper bound
-	var sortedCycleKeys []string
-	for k := range hist.CycleExtensionDurationHistogram {
-		sortedCycleKeys = append(sortedCycleKeys, k)
+func (p inlineCredentialProvider) Get(ctx context.Context) (string, string, error) {
+	return p.user, p.pass, nil
+}
+
+// envCredentialProvider reads the username and password from two env vars
+// named by ref in "USER_VAR:PASS_VAR" form.
+type envCredentialProvider struct {
+	ref string
+}
+
+func (p envCredentialProvider) Get(ctx context.Context) (string, string, error) {
+	userVar, passVar, ok := strings.Cut(p.ref, ":")
+	if !ok {
+		return "", "", fmt.Errorf("env credentialRef must be \"USER_VAR:PASS_VAR\", got %q", p.ref)
 	}
-	sort.Slice(sortedCycleKeys, func(i, j int) bool {
-		return parseBucketUpperBoundMs(sortedCycleKeys[i]) < parseBucketUpperBoundMs(sortedCycleKeys[j])
-	})
-	cumulative = 0
-	for _, k := range sortedCycleKeys {
-		cumulative += float64(hist.CycleExtensionDurationHistogram[k])
-		le := strconv.FormatFloat(parseBucketUpperBoundMs(k), 'f', -1, 64)
-		curr := cycleExtensionBuckets.WithLabelValues(vplc_instance, le)
-		delta := cumulative - getPreviousBucketValue("cycle", vplc_instance+"|"+le)
-		if delta > 0 {
-			curr.Add(delta)
-		}
-		setPreviousBucketValue("cycle", vplc_instance+"|"+le, cumulative)
+	user, pass := os.Getenv(userVar), os.Getenv(passVar)
+	if user == "" || pass == "" {
+		return "", "", fmt.Errorf("env vars %s/%s are not both set", userVar, passVar)
+	}
+	return user, pass, nil
+}
+
+// fileCredentialProvider reads "user:pass" from a secret file at ref. The
+// file must not be group- or world-readable.
+type fileCredentialProvider struct {
+	path string
+}
+
+func (p fileCredentialProvider) Get(ctx context.Context) (string, string, error) {
+	if err := rejectWorldReadable(p.path); err != nil {
+		return "", "", err
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read credential file %s: %v", p.path, err)
+	}
+	user, pass, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return "", "", fmt.Errorf("credential file %s must contain \"user:pass\"", p.path)
 	}
+	return user, pass, nil
+}
+
+// vaultCredentialProvider fetches user/password fields from a Vault KV v2
+// secret at path, authenticating with VAULT_ADDR/VAULT_TOKEN.
+type vaultCredentialProvider struct {
+	path string
 }
 
-func getPreviousBucketValue(kind, key string) float64 {
-	switch kind {
-	case "write":
-		return prevWriteBuckets[key]
-	case "cycle":
-		return prevCycleBuckets[key]
+func (p vaultCredentialProvider) Get(ctx context.Context) (string, string, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set for the vault credential source")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(addr, "/")+"/v1/"+p.path, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("vault request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("vault request failed with status %d", resp.StatusCode)
+	}
+
+	var parsed struct {
+		Data struct {
+			Data struct {
+				User     string `json:"user"`
+				Password string `json:"password"`
+			} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", "", fmt.Errorf("failed to parse vault response: %v", err)
+	}
+	if parsed.Data.Data.User == "" || parsed.Data.Data.Password == "" {
+		return "", "", fmt.Errorf("vault secret %s is missing user/password fields", p.path)
+	}
+	return parsed.Data.Data.User, parsed.Data.Data.Password, nil
+}
+
+// k8sSecretCredentialProvider reads the "user"/"password" keys of a
+// Kubernetes Secret ref ("namespace/secretName") via the in-cluster API,
+// authenticating with the pod's mounted service account token.
+type k8sSecretCredentialProvider struct {
+	ref string
+}
+
+func (p k8sSecretCredentialProvider) Get(ctx context.Context) (string, string, error) {
+	namespace, name, ok := strings.Cut(p.ref, "/")
+	if !ok {
+		return "", "", fmt.Errorf("k8s-secret credentialRef must be \"namespace/secretName\", got %q", p.ref)
 	}
-	return 0
+
+	const saDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	token, err := os.ReadFile(saDir + "/token")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read service account token: %v", err)
+	}
+	caPEM, err := os.ReadFile(saDir + "/ca.crt")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return "", "", fmt.Errorf("no certificates found in service account CA")
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", "", fmt.Errorf("not running in-cluster: KUBERNETES_SERVICE_HOST/PORT are unset")
+	}
+	url := fmt.Sprintf("https://%s/api/v1/namespaces/%s/secrets/%s", net.JoinHostPort(host, port), namespace, name)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("k8s secret request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("k8s secret request failed with status %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", "", fmt.Errorf("failed to parse k8s secret response: %v", err)
+	}
+	userB64, userOk := secret.Data["user"]
+	passB64, passOk := secret.Data["password"]
+	if !userOk || !passOk {
+		return "", "", fmt.Errorf("k8s secret %s/%s is missing user/password keys", namespace, name)
+	}
+	user, err := base64.StdEncoding.DecodeString(userB64)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode user from k8s secret: %v", err)
+	}
+	pass, err := base64.StdEncoding.DecodeString(passB64)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode password from k8s secret: %v", err)
+	}
+	return string(user), string(pass), nil
+}
+
+// rejectWorldReadable errors if path grants any permission (read, write or
+// execute) to group or other, for secret material that must only be
+// accessible to the exporter's own user.
+func rejectWorldReadable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s must not grant any access to group or other (mode %v)", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Token Caching and Expiry
+//
+// authenticate is a real login call, so timedAuthenticate caches its result
+// per vplc and reuses it until shortly before expiry instead of
+// re-authenticating on every /probe. Expiry is read from the token's own
+// JWT "exp" claim when present, falling back to TOKEN_DEFAULT_TTL_SECONDS
+// otherwise; scrapeVplc also invalidates the cache when a data request is
+// rejected with 401/403 (other failures keep the cached token), so a token
+// rejected by the vplc (e.g. revoked early) is replaced on the
+// very next probe rather than waiting out the rest of its nominal TTL.
+const tokenRefreshSkew = 30 * time.Second
+
+var defaultTokenTTL = durationSecondsFromEnv("TOKEN_DEFAULT_TTL_SECONDS", 300)
+
+type cachedToken struct {
+	token     string
+	issuedAt  time.Time
+	expiresAt time.Time
+}
+
+var (
+	tokenCache   = make(map[string]cachedToken)
+	tokenCacheMu sync.Mutex
+)
+
+func getCachedToken(vplc_instance string) (string, bool) {
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
+	t, ok := tokenCache[vplc_instance]
+	if !ok || time.Now().After(t.expiresAt) {
+		return "", false
+	}
+	authTokenAge.WithLabelValues(vplc_instance).Set(time.Since(t.issuedAt).Seconds())
+	return t.token, true
+}
+
+func setCachedToken(vplc_instance, token string, issuedAt, expiresAt time.Time) {
+	tokenCacheMu.Lock()
+	tokenCache[vplc_instance] = cachedToken{token: token, issuedAt: issuedAt, expiresAt: expiresAt}
+	tokenCacheMu.Unlock()
+}
+
+func invalidateCachedToken(vplc_instance string) {
+	tokenCacheMu.Lock()
+	delete(tokenCache, vplc_instance)
+	tokenCacheMu.Unlock()
+}
+
+// authRefreshLocks serializes timedAuthenticate's check-then-refresh
+// sequence per vplc, so concurrent /probe requests racing a cache miss
+// reuse the first request's freshly obtained token instead of each making
+// their own redundant login (or Vault/k8s-secret) call.
+var authRefreshLocks sync.Map // map[string]*sync.Mutex
+
+func authRefreshLock(vplc_instance string) *sync.Mutex {
+	l, _ := authRefreshLocks.LoadOrStore(vplc_instance, &sync.Mutex{})
+	return l.(*sync.Mutex)
 }
 
-func setPreviousBucketValue(kind, key string, val float64) {
-	switch kind {
-	case "write":
-		prevWriteBuckets[key] = val
-	case "cycle":
-		prevCycleBuckets[key] = val
+// parseJWTExpiry extracts the "exp" (Unix seconds) claim from a JWT's
+// payload segment without verifying its signature. The exporter already
+// trusts the vplc it authenticated against over the same connection, so
+// this is only used to schedule a proactive refresh, never to authorize.
+func parseJWTExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
 	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
 }
 
 // Update readAccessFile to return a list of VplcAccess
 func readAccessFile() []VplcAccess {
 	filePath := os.Getenv("VPLC_ACCESS_FILE")
 	if filePath == "" {
-		log.Fatalf("Environment variable VPLC_ACCESS_FILE is not set or empty")
+		logger.Error("environment variable VPLC_ACCESS_FILE is not set or empty")
+		os.Exit(1)
+	}
+	if err := rejectWorldReadable(filePath); err != nil {
+		logger.Error("refusing to read access file", "err", err)
+		os.Exit(1)
 	}
 	f, err := os.Open(filePath)
 	if err != nil {
-		log.Fatalf("Error opening access file: %v", err)
+		logger.Error("failed to open access file", "err", err)
+		os.Exit(1)
 	}
 	defer f.Close()
 	data, err := io.ReadAll(f)
 	if err != nil {
-		log.Fatalf("Error reading access file: %v", err)
+		logger.Error("failed to read access file", "err", err)
+		os.Exit(1)
 	}
 	var accessList VplcAccessList
 	if err := json.Unmarshal(data, &accessList); err != nil {
-		log.Fatalf("Error parsing access file: %v", err)
+		logger.Error("failed to parse access file", "err", err)
+		os.Exit(1)
 	}
 	return accessList.Instances
 }
 
-func authenticate(client *http.Client, loginUrl, username, password string) (string, error) {
+func authenticate(ctx context.Context, client *http.Client, vplc_instance, loginUrl, username, password string) (string, error) {
+	start := time.Now()
 	loginData := fmt.Sprintf(`{"username":"%s","password":"%s"}`, username, password)
-	req, err := http.NewRequest("POST", loginUrl, strings.NewReader(loginData))
+	req, err := http.NewRequestWithContext(ctx, "POST", loginUrl, strings.NewReader(loginData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.Do(req)
+	durationMs := time.Since(start).Milliseconds()
 	if err != nil {
+		logger.Error("authentication request failed", "vplc_instance", vplc_instance, "url", loginUrl, "duration_ms", durationMs, "err", err)
 		return "", fmt.Errorf("authentication failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		logger.Warn("authentication failed", "vplc_instance", vplc_instance, "url", loginUrl, "status_code", resp.StatusCode, "duration_ms", durationMs)
 		return "", fmt.Errorf("authentication failed with status: %d", resp.StatusCode)
 	}
 
@@ -329,25 +800,29 @@ func authenticate(client *http.Client, loginUrl, username, password string) (str
 		return "", fmt.Errorf("no access token in response")
 	}
 
-	log.Printf("Authentication successful: %s", loginUrl)
+	logger.Debug("authentication successful", "vplc_instance", vplc_instance, "url", loginUrl, "status_code", resp.StatusCode, "duration_ms", durationMs)
 	return token, nil
 }
 
-func sendApiRequest(client *http.Client, url, token string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func sendApiRequest(ctx context.Context, client *http.Client, vplc_instance, url, token string) ([]byte, error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Cookie", "authToken="+token)
 
 	resp, err := client.Do(req)
+	durationMs := time.Since(start).Milliseconds()
 	if err != nil {
+		logger.Error("api request failed", "vplc_instance", vplc_instance, "url", url, "duration_ms", durationMs, "err", err)
 		return nil, fmt.Errorf("API request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status: %d", resp.StatusCode)
+		logger.Warn("api request returned non-200", "vplc_instance", vplc_instance, "url", url, "status_code", resp.StatusCode, "duration_ms", durationMs)
+		return nil, &apiStatusError{statusCode: resp.StatusCode}
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -355,89 +830,527 @@ func sendApiRequest(client *http.Client, url, token string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read response body: %v", err)
 	}
 
+	logger.Debug("api request succeeded", "vplc_instance", vplc_instance, "url", url, "status_code", resp.StatusCode, "duration_ms", durationMs)
 	return body, nil
 }
 
+// apiStatusError preserves the upstream HTTP status code so callers can
+// distinguish a token rejected by the vplc (401/403) from a transient or
+// unrelated failure, rather than invalidating a perfectly good cached token
+// on every non-200 response.
+type apiStatusError struct {
+	statusCode int
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("API request failed with status: %d", e.statusCode)
+}
+
+// isAuthRejection reports whether err indicates the vplc rejected the
+// token itself, as opposed to some other request failure.
+func isAuthRejection(err error) bool {
+	var statusErr *apiStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.statusCode == http.StatusUnauthorized || statusErr.statusCode == http.StatusForbidden
+}
+
+// Self-Observability Metrics
+//
+// Unlike the per-probe metricsSet above, these track the exporter's own
+// scrape health across every vplc and every call it makes, so they live on
+// the process-wide default registry (served on /metrics) rather than being
+// rebuilt per request. They're what alerting on partial vplc outages is
+// based on, since scrape failures otherwise only show up in logs; /readyz
+// consults its own lastSuccessAt record below instead.
+var (
+	scrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "vplc_scrape_duration_seconds",
+			Help:    "Duration of each upstream vplc API call made by the exporter",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"vplc_instance", "endpoint"},
+	)
+	scrapeSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vplc_scrape_success",
+			Help: "Whether the last call to this vplc endpoint succeeded (1) or failed (0)",
+		},
+		[]string{"vplc_instance", "endpoint"},
+	)
+	scrapeErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vplc_scrape_errors_total",
+			Help: "Total scrape errors per vplc endpoint, labeled by reason (auth, http, parse, timeout)",
+		},
+		[]string{"vplc_instance", "endpoint", "reason"},
+	)
+	authTokenAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vplc_auth_token_age_seconds",
+			Help: "Age of the access token last obtained for this vplc",
+		},
+		[]string{"vplc_instance"},
+	)
+	lastSuccessfulScrape = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vplc_last_successful_scrape_timestamp_seconds",
+			Help: "Unix timestamp of the last fully successful scrape of this vplc",
+		},
+		[]string{"vplc_instance"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scrapeDuration, scrapeSuccess, scrapeErrorsTotal, authTokenAge, lastSuccessfulScrape)
+}
+
+// lastSuccessAt backs /readyz: lastSuccessfulScrape above is convenient for
+// PromQL but awkward to read back out of the client library, so the
+// timestamp is also kept here for the health check to consult directly.
+var (
+	lastSuccessAt    = make(map[string]time.Time)
+	lastSuccessMu    sync.Mutex
+	healthStaleAfter = durationSecondsFromEnv("HEALTH_STALE_AFTER_SECONDS", 90)
+)
+
+func durationSecondsFromEnv(envVar string, defaultSeconds int) time.Duration {
+	raw := os.Getenv(envVar)
+	if raw == "" {
+		return time.Duration(defaultSeconds) * time.Second
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.Warn("invalid duration, falling back to default", "env_var", envVar, "value", raw)
+		return time.Duration(defaultSeconds) * time.Second
+	}
+	return time.Duration(v) * time.Second
+}
+
+func recordSuccessfulScrape(vplc_instance string) {
+	now := time.Now()
+	lastSuccessMu.Lock()
+	lastSuccessAt[vplc_instance] = now
+	lastSuccessMu.Unlock()
+	lastSuccessfulScrape.WithLabelValues(vplc_instance).Set(float64(now.Unix()))
+}
+
+// anyRecentSuccess reports whether any configured vplc has scraped
+// successfully within staleAfter.
+func anyRecentSuccess(staleAfter time.Duration) bool {
+	lastSuccessMu.Lock()
+	defer lastSuccessMu.Unlock()
+	for _, t := range lastSuccessAt {
+		if time.Since(t) <= staleAfter {
+			return true
+		}
+	}
+	return false
+}
+
+// recordScrape updates the self-observability metrics for one upstream call:
+// duration, success/failure, and, on failure, an error counter tagged with
+// defaultReason, refined to "timeout" when the error indicates one.
+func recordScrape(vplc_instance, endpoint string, start time.Time, err error, defaultReason string) {
+	scrapeDuration.WithLabelValues(vplc_instance, endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		scrapeSuccess.WithLabelValues(vplc_instance, endpoint).Set(0)
+		scrapeErrorsTotal.WithLabelValues(vplc_instance, endpoint, classifyErrorReason(err, defaultReason)).Inc()
+		return
+	}
+	scrapeSuccess.WithLabelValues(vplc_instance, endpoint).Set(1)
+}
+
+// classifyErrorReason maps a request error to one of the
+// vplc_scrape_errors_total reasons, defaulting to defaultReason unless the
+// error looks like a timeout.
+func classifyErrorReason(err error, defaultReason string) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return defaultReason
+}
+
+// timedAuthenticate wraps authenticate with self-observability
+// instrumentation for the "login" endpoint, including the freshly obtained
+// token's age.
+func timedAuthenticate(ctx context.Context, client *http.Client, vplc VplcAccess) (string, error) {
+	if token, ok := getCachedToken(vplc.Name); ok {
+		return token, nil
+	}
+
+	// Serialize the refresh per vplc: concurrent /probe requests racing a
+	// cache miss should share one login call rather than each making their
+	// own, so re-check the cache once we hold the lock in case another
+	// request already refreshed it while we were waiting.
+	lock := authRefreshLock(vplc.Name)
+	lock.Lock()
+	defer lock.Unlock()
+	if token, ok := getCachedToken(vplc.Name); ok {
+		return token, nil
+	}
+
+	provider, err := vplc.credentialProvider()
+	if err != nil {
+		recordScrape(vplc.Name, "login", time.Now(), err, "auth")
+		return "", err
+	}
+	user, pass, err := provider.Get(ctx)
+	if err != nil {
+		recordScrape(vplc.Name, "login", time.Now(), err, "auth")
+		return "", err
+	}
+
+	start := time.Now()
+	token, err := authenticate(ctx, client, vplc.Name, vplc.LoginUrl, user, pass)
+	recordScrape(vplc.Name, "login", start, err, "auth")
+	if err != nil {
+		return "", err
+	}
+
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(defaultTokenTTL - tokenRefreshSkew)
+	if exp, ok := parseJWTExpiry(token); ok {
+		expiresAt = exp.Add(-tokenRefreshSkew)
+	}
+	setCachedToken(vplc.Name, token, issuedAt, expiresAt)
+	authTokenAge.WithLabelValues(vplc.Name).Set(0)
+	return token, nil
+}
+
+// timedApiRequest wraps sendApiRequest with the same instrumentation for a
+// data endpoint ("histogram" or "crb").
+func timedApiRequest(ctx context.Context, client *http.Client, vplc VplcAccess, endpoint, url, token string) ([]byte, error) {
+	start := time.Now()
+	body, err := sendApiRequest(ctx, client, vplc.Name, url, token)
+	recordScrape(vplc.Name, endpoint, start, err, "http")
+	return body, err
+}
+
+// lookupVplc resolves a /probe target against the configured vplc list,
+// matching on the instance name (the common case, paired with /http_sd) or
+// on its apiUrl (so `target=<url>&module=v2` also works for a vplc that
+// Prometheus discovered by some other means).
+func lookupVplc(vplcList []VplcAccess, target string) (VplcAccess, bool) {
+	for _, vplc := range vplcList {
+		if vplc.Name == target || vplc.ApiUrl == target {
+			return vplc, true
+		}
+	}
+	return VplcAccess{}, false
+}
+
+// scrapeVplc authenticates against vplc, populates ms with a single, fresh
+// snapshot of its CRB metrics for one /probe response and feeds its
+// histogram buckets into the cumulative histograms on crbRegistry,
+// recording self-observability metrics for every call it makes along the
+// way. ctx is the triggering /probe request's context, so the upstream calls
+// are abandoned if the scrape is cancelled or the server is shutting down.
+func scrapeVplc(ctx context.Context, client *http.Client, vplc VplcAccess, ms *metricsSet) error {
+	token, err := timedAuthenticate(ctx, client, vplc)
+	if err != nil {
+		return fmt.Errorf("authentication failed for vplc %s: %v", vplc.Name, err)
+	}
+
+	body, err := timedApiRequest(ctx, client, vplc, "histogram", vplc.ApiUrl+"/retain/cyclic-backup/histogram", token)
+	if err != nil {
+		if isAuthRejection(err) {
+			invalidateCachedToken(vplc.Name)
+		}
+		return fmt.Errorf("failed to get histogram data for vplc %s: %v", vplc.Name, err)
+	}
+	var hist Histogram
+	if err := json.Unmarshal(body, &hist); err != nil {
+		scrapeErrorsTotal.WithLabelValues(vplc.Name, "histogram", "parse").Inc()
+		return fmt.Errorf("error parsing histogram data for vplc %s: %v", vplc.Name, err)
+	}
+	updateHistograms(hist, vplc.Name)
+
+	bodyStats, err := timedApiRequest(ctx, client, vplc, "crb", vplc.ApiUrl+"/retain/cyclic-backup", token)
+	if err != nil {
+		if isAuthRejection(err) {
+			invalidateCachedToken(vplc.Name)
+		}
+		return fmt.Errorf("failed to get CRB stats for vplc %s: %v", vplc.Name, err)
+	}
+	var crb map[string]interface{}
+	if err := json.Unmarshal(bodyStats, &crb); err != nil {
+		scrapeErrorsTotal.WithLabelValues(vplc.Name, "crb", "parse").Inc()
+		return fmt.Errorf("error parsing CRB metrics for vplc %s: %v", vplc.Name, err)
+	}
+	updateCRBMetrics(ms, crb, vplc.Name)
+
+	recordSuccessfulScrape(vplc.Name)
+	return nil
+}
+
+// handleProbe implements the multi-target exporter `/probe?target=` pattern:
+// it authenticates and scrapes the one named vplc on demand, so scrape
+// cadence is controlled by Prometheus rather than a fixed ticker and one
+// slow vplc can never cause another's scrape to be skipped. The response
+// merges this probe's fresh per-vplc gauges and counters with the cumulative
+// histograms and summaries on the process-wide crbRegistry (see
+// "Metric Registration and Storage" above), so every probe also carries the
+// running totals built up across every vplc scraped so far.
+func handleProbe(vplcList []VplcAccess, client *http.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		module := r.URL.Query().Get("module")
+		if module == "" {
+			module = "v2"
+		}
+		if module != "v2" {
+			http.Error(w, fmt.Sprintf("unsupported module %q", module), http.StatusBadRequest)
+			return
+		}
+
+		vplc, ok := lookupVplc(vplcList, target)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusNotFound)
+			return
+		}
+
+		ms := newMetricsSet()
+		if err := scrapeVplc(r.Context(), client, vplc, ms); err != nil {
+			logger.Error("probe failed", "vplc_instance", vplc.Name, "url", vplc.ApiUrl, "err", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		gatherer := prometheus.Gatherers{ms.registry, crbRegistry}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// sdTarget is one element of the Prometheus HTTP service discovery response
+// format (https://prometheus.io/docs/prometheus/latest/http_sd/).
+type sdTarget struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// handleHTTPSD exposes the configured vplcs as a Prometheus HTTP SD target
+// list, so a scrape config can discover them dynamically and relabel
+// __address__ to this exporter with __param_target set from the label,
+// rather than the access file needing a matching static_config.
+func handleHTTPSD(vplcList []VplcAccess) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targets := make([]sdTarget, 0, len(vplcList))
+		for _, vplc := range vplcList {
+			targets = append(targets, sdTarget{
+				Targets: []string{vplc.Name},
+				Labels: map[string]string{
+					"vplc_instance":         vplc.Name,
+					"__meta_vplc_api_url":   vplc.ApiUrl,
+					"__meta_vplc_login_url": vplc.LoginUrl,
+				},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(targets); err != nil {
+			logger.Error("failed to encode http_sd response", "err", err)
+		}
+	}
+}
+
+// handleHealthz always reports ok: it only confirms the process is alive and
+// serving, not that any vplc is reachable (that's /readyz's job).
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports 503 once no configured vplc has scraped successfully
+// within healthStaleAfter, so alerting can distinguish "process is up" from
+// "actually collecting data" during a partial vplc outage.
+func handleReadyz(vplcList []VplcAccess) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(vplcList) > 0 && !anyRecentSuccess(healthStaleAfter) {
+			http.Error(w, "no successful vplc scrape within "+healthStaleAfter.String(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// Server Hardening, TLS/mTLS and Basic Auth
+//
+// These mirror the `web.config.file` knobs upstream Prometheus exporters
+// expose via exporter-toolkit: the metrics endpoint can terminate TLS itself
+// (optionally requiring a client certificate signed by METRICS_CLIENT_CA),
+// and/or require HTTP basic auth against an htpasswd-style bcrypt file,
+// rather than always serving plaintext with no credentials.
+const (
+	metricsReadHeaderTimeout = 5 * time.Second
+	metricsReadTimeout       = 10 * time.Second
+	metricsWriteTimeout      = 30 * time.Second
+	metricsIdleTimeout       = 120 * time.Second
+	shutdownTimeout          = 10 * time.Second
+)
+
+// loadBasicAuthUsers parses an htpasswd-style file (one "user:bcrypthash"
+// entry per line, blank lines and "#" comments ignored) into a lookup table.
+// An empty path disables basic auth entirely.
+func loadBasicAuthUsers(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := rejectWorldReadable(path); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed entry in %s: %q", path, line)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return users, nil
+}
+
+// basicAuthMiddleware enforces HTTP basic auth against users when non-empty,
+// and is a no-op passthrough when basic auth isn't configured.
+func basicAuthMiddleware(users map[string]string, next http.Handler) http.Handler {
+	if len(users) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		hash, known := users[user]
+		if !ok || !known || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="vplc_collector"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// configureTLS builds a *tls.Config for the metrics server from
+// METRICS_TLS_CERT/METRICS_TLS_KEY and, if METRICS_CLIENT_CA is also set,
+// requires and verifies a client certificate for mTLS scrape auth. Returns
+// nil (plain HTTP) if neither TLS env var is set.
+func configureTLS() (*tls.Config, error) {
+	certFile := os.Getenv("METRICS_TLS_CERT")
+	keyFile := os.Getenv("METRICS_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("METRICS_TLS_CERT and METRICS_TLS_KEY must both be set")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metrics TLS keypair: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile := os.Getenv("METRICS_CLIENT_CA"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read METRICS_CLIENT_CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in METRICS_CLIENT_CA %s", caFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
 func main() {
 	vplcList := readAccessFile()
 	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
 	client := &http.Client{Transport: tr}
 
-	for _, vplc := range vplcList {
-		go func(vplc VplcAccess) {
-			vplc_instance := vplc.Name
-			var token string
-			var authenticated bool
-			ticker := time.NewTicker(10 * time.Second)
-			defer ticker.Stop()
-			var running int32 // 0 = not running, 1 = running
-
-			for range ticker.C {
-				if !atomic.CompareAndSwapInt32(&running, 0, 1) {
-					// Previous run still in progress, skip this tick
-					log.Printf("Previous run still in progress for vplc %s, skipping this interval", vplc_instance)
-					continue
-				}
+	basicAuthUsers, err := loadBasicAuthUsers(os.Getenv("METRICS_BASIC_AUTH_USERS"))
+	if err != nil {
+		logger.Error("failed to load basic auth users", "err", err)
+		os.Exit(1)
+	}
+	tlsConfig, err := configureTLS()
+	if err != nil {
+		logger.Error("failed to configure metrics TLS", "err", err)
+		os.Exit(1)
+	}
 
-				go func() {
-					defer atomic.StoreInt32(&running, 0)
-					defer func() {
-						if r := recover(); r != nil {
-							log.Printf("Recovered from panic for vplc %s: %v", vplc_instance, r)
-							authenticated = false
-							token = ""
-						}
-					}()
-
-					// Check if we need to authenticate
-					if !authenticated || token == "" {
-						var err error
-						token, err = authenticate(client, vplc.LoginUrl, vplc.UserName, vplc.Password)
-						if err != nil {
-							log.Printf("Authentication failed for vplc %s: %v", vplc_instance, err)
-							authenticated = false
-							return // Skip this cycle
-						}
-						authenticated = true
-					}
-
-					// Try to get histogram data
-					body, err := sendApiRequest(client, vplc.ApiUrl+"/retain/cyclic-backup/histogram", token)
-					if err != nil {
-						log.Printf("Failed to get histogram data for vplc %s: %v", vplc_instance, err)
-						authenticated = false
-						token = ""
-						return
-					}
-
-					var hist Histogram
-					if err := json.Unmarshal(body, &hist); err != nil {
-						log.Printf("Error parsing histogram data for vplc %s: %v", vplc_instance, err)
-					} else {
-						updateHistograms(hist, vplc_instance)
-					}
-
-					// Try to get CRB stats
-					bodyStats, err := sendApiRequest(client, vplc.ApiUrl+"/retain/cyclic-backup", token)
-					if err != nil {
-						log.Printf("Failed to get CRB stats for vplc %s: %v", vplc_instance, err)
-						authenticated = false // Mark as unauthenticated to retry auth next cycle
-						token = ""
-						return
-					}
-
-					var crb map[string]interface{}
-					if err := json.Unmarshal(bodyStats, &crb); err != nil {
-						log.Printf("Error parsing CRB metrics for vplc %s: %v", vplc_instance, err)
-					} else {
-						updateCRBMetrics(crb, vplc_instance)
-					}
-				}()
-			}
-		}(vplc)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/probe", handleProbe(vplcList, client))
+	mux.HandleFunc("/http_sd", handleHTTPSD(vplcList))
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz(vplcList))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              ":2112",
+		Handler:           basicAuthMiddleware(basicAuthUsers, mux),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: metricsReadHeaderTimeout,
+		ReadTimeout:       metricsReadTimeout,
+		WriteTimeout:      metricsWriteTimeout,
+		IdleTimeout:       metricsIdleTimeout,
+		// Deliberately NOT ctx: requests must survive the shutdown signal
+		// so they get the full shutdownTimeout grace period below to
+		// finish their upstream vplc call. ctx only triggers Shutdown and
+		// (via the forced Close after it) hard-cancels any stragglers once
+		// that grace period has elapsed.
+		BaseContext: func(net.Listener) context.Context { return context.Background() },
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Println("Serving metrics on :2112/metrics")
-	log.Fatal(http.ListenAndServe(":2112", nil))
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			logger.Info("serving /probe, /http_sd, /healthz, /readyz and /metrics over TLS", "addr", srv.Addr)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			logger.Info("serving /probe, /http_sd, /healthz, /readyz and /metrics", "addr", srv.Addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("http server stopped", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logger.Info("shutdown signal received, draining in-flight requests", "grace_period", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// The grace period elapsed with requests still in flight; force
+		// their connections closed rather than waiting indefinitely.
+		logger.Error("graceful shutdown timed out, forcing close", "err", err)
+		srv.Close()
+	}
 }
@@ -0,0 +1,540 @@
+/*
+ Copyright (c) Siemens 2025
+This file is subject to the terms and conditions of the MIT License.
+See LICENSE file in the top-level directory.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBucketRangeMs(t *testing.T) {
+	cases := []struct {
+		bucket     string
+		lower      float64
+		upper      float64
+		upperIsInf bool
+		ok         bool
+	}{
+		{bucket: "0.0-1.0ms", lower: 0, upper: 1, ok: true},
+		{bucket: "1.0-2.0ms", lower: 1, upper: 2, ok: true},
+		{bucket: "20.0+ms", lower: 20, upperIsInf: true, ok: true},
+		{bucket: "0.5ms", lower: 0.5, upper: 0.5, ok: true},
+		{bucket: "not-a-bucket", ok: false},
+		{bucket: "0.0-1.0", ok: false},
+		{bucket: "", ok: false},
+	}
+
+	for _, c := range cases {
+		lower, upper, ok := parseBucketRangeMs(c.bucket)
+		if ok != c.ok {
+			t.Errorf("parseBucketRangeMs(%q) ok = %v, want %v", c.bucket, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if lower != c.lower {
+			t.Errorf("parseBucketRangeMs(%q) lower = %v, want %v", c.bucket, lower, c.lower)
+		}
+		if c.upperIsInf {
+			if !math.IsInf(upper, 1) {
+				t.Errorf("parseBucketRangeMs(%q) upper = %v, want +Inf", c.bucket, upper)
+			}
+			continue
+		}
+		if upper != c.upper {
+			t.Errorf("parseBucketRangeMs(%q) upper = %v, want %v", c.bucket, upper, c.upper)
+		}
+	}
+}
+
+func TestBucketMidpointMs(t *testing.T) {
+	cases := []struct {
+		bucket string
+		want   float64
+	}{
+		{bucket: "0.0-1.0ms", want: 0.5},
+		{bucket: "10.0-20.0ms", want: 15},
+		{bucket: "20.0+ms", want: 20}, // overflow bucket has no upper bound, so reports its lower edge
+		{bucket: "garbage", want: 0},
+	}
+
+	for _, c := range cases {
+		if got := bucketMidpointMs(c.bucket); got != c.want {
+			t.Errorf("bucketMidpointMs(%q) = %v, want %v", c.bucket, got, c.want)
+		}
+	}
+}
+
+func jwtWithPayload(t *testing.T, payload any) string {
+	t.Helper()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal JWT payload: %v", err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(body) + ".sig"
+}
+
+func TestParseJWTExpiry(t *testing.T) {
+	expiry := time.Unix(1700000000, 0)
+
+	t.Run("valid exp claim", func(t *testing.T) {
+		token := jwtWithPayload(t, map[string]any{"exp": expiry.Unix()})
+		got, ok := parseJWTExpiry(token)
+		if !ok {
+			t.Fatalf("parseJWTExpiry(%q) ok = false, want true", token)
+		}
+		if !got.Equal(expiry) {
+			t.Errorf("parseJWTExpiry(%q) = %v, want %v", token, got, expiry)
+		}
+	})
+
+	t.Run("missing exp claim", func(t *testing.T) {
+		token := jwtWithPayload(t, map[string]any{"sub": "vplc"})
+		if _, ok := parseJWTExpiry(token); ok {
+			t.Errorf("parseJWTExpiry(%q) ok = true, want false", token)
+		}
+	})
+
+	t.Run("not a JWT", func(t *testing.T) {
+		if _, ok := parseJWTExpiry("not-a-jwt"); ok {
+			t.Error("parseJWTExpiry on a non-JWT token ok = true, want false")
+		}
+	})
+
+	t.Run("malformed base64 payload", func(t *testing.T) {
+		token := "header.not!valid!base64.sig"
+		if _, ok := parseJWTExpiry(token); ok {
+			t.Error("parseJWTExpiry with unparseable payload ok = true, want false")
+		}
+	})
+
+	t.Run("payload not JSON", func(t *testing.T) {
+		token := "header." + base64.RawURLEncoding.EncodeToString([]byte("not json")) + ".sig"
+		if _, ok := parseJWTExpiry(token); ok {
+			t.Error("parseJWTExpiry with non-JSON payload ok = true, want false")
+		}
+	})
+}
+
+func TestRejectWorldReadable(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []struct {
+		name    string
+		mode    os.FileMode
+		wantErr bool
+	}{
+		{name: "owner-only", mode: 0600, wantErr: false},
+		{name: "group-readable", mode: 0640, wantErr: true},
+		{name: "world-readable", mode: 0644, wantErr: true},
+		{name: "world-writable", mode: 0602, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, c.name)
+			if err := os.WriteFile(path, []byte("secret"), c.mode); err != nil {
+				t.Fatalf("failed to write test file: %v", err)
+			}
+			// WriteFile's mode is subject to umask, which can silently
+			// strip the very bits this test is asserting on; force it.
+			if err := os.Chmod(path, c.mode); err != nil {
+				t.Fatalf("failed to chmod test file: %v", err)
+			}
+			err := rejectWorldReadable(path)
+			if (err != nil) != c.wantErr {
+				t.Errorf("rejectWorldReadable(%s, mode %v) error = %v, wantErr %v", c.name, c.mode, err, c.wantErr)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if err := rejectWorldReadable(filepath.Join(dir, "does-not-exist")); err == nil {
+			t.Error("rejectWorldReadable on a missing file returned nil error")
+		}
+	})
+}
+
+type fakeNetError struct {
+	timeout bool
+}
+
+func (e *fakeNetError) Error() string   { return "fake net error" }
+func (e *fakeNetError) Timeout() bool   { return e.timeout }
+func (e *fakeNetError) Temporary() bool { return false }
+
+func TestClassifyErrorReason(t *testing.T) {
+	cases := []struct {
+		name          string
+		err           error
+		defaultReason string
+		want          string
+	}{
+		{name: "timeout net error", err: fmt.Errorf("wrap: %w", &fakeNetError{timeout: true}), defaultReason: "http", want: "timeout"},
+		{name: "non-timeout net error", err: fmt.Errorf("wrap: %w", &fakeNetError{timeout: false}), defaultReason: "http", want: "http"},
+		{name: "generic error", err: errors.New("boom"), defaultReason: "auth", want: "auth"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := classifyErrorReason(c.err, c.defaultReason); got != c.want {
+				t.Errorf("classifyErrorReason(%v, %q) = %q, want %q", c.err, c.defaultReason, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAnyRecentSuccess(t *testing.T) {
+	lastSuccessMu.Lock()
+	saved := lastSuccessAt
+	lastSuccessAt = make(map[string]time.Time)
+	lastSuccessMu.Unlock()
+	t.Cleanup(func() {
+		lastSuccessMu.Lock()
+		lastSuccessAt = saved
+		lastSuccessMu.Unlock()
+	})
+
+	if anyRecentSuccess(time.Minute) {
+		t.Error("anyRecentSuccess with no recorded scrapes = true, want false")
+	}
+
+	lastSuccessMu.Lock()
+	lastSuccessAt["vplc-a"] = time.Now().Add(-2 * time.Minute)
+	lastSuccessMu.Unlock()
+	if anyRecentSuccess(time.Minute) {
+		t.Error("anyRecentSuccess with only a stale scrape = true, want false")
+	}
+
+	lastSuccessMu.Lock()
+	lastSuccessAt["vplc-b"] = time.Now()
+	lastSuccessMu.Unlock()
+	if !anyRecentSuccess(time.Minute) {
+		t.Error("anyRecentSuccess with one fresh scrape = false, want true")
+	}
+}
+
+func TestLoadBasicAuthUsers(t *testing.T) {
+	t.Run("no path configured", func(t *testing.T) {
+		users, err := loadBasicAuthUsers("")
+		if err != nil || users != nil {
+			t.Errorf("loadBasicAuthUsers(\"\") = %v, %v, want nil, nil", users, err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := loadBasicAuthUsers(filepath.Join(t.TempDir(), "missing")); err == nil {
+			t.Error("loadBasicAuthUsers on a missing file returned nil error")
+		}
+	})
+
+	t.Run("world readable file rejected", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.htpasswd")
+		if err := os.WriteFile(path, []byte("alice:hash\n"), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		if _, err := loadBasicAuthUsers(path); err == nil {
+			t.Error("loadBasicAuthUsers on a world-readable file returned nil error")
+		}
+	})
+
+	t.Run("parses entries, skipping blanks and comments", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.htpasswd")
+		content := "# comment\n\nalice:$2y$10$hash1\nbob:$2y$10$hash2\n"
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		users, err := loadBasicAuthUsers(path)
+		if err != nil {
+			t.Fatalf("loadBasicAuthUsers(%s) returned error: %v", path, err)
+		}
+		want := map[string]string{"alice": "$2y$10$hash1", "bob": "$2y$10$hash2"}
+		if len(users) != len(want) {
+			t.Fatalf("loadBasicAuthUsers(%s) = %v, want %v", path, users, want)
+		}
+		for user, hash := range want {
+			if users[user] != hash {
+				t.Errorf("loadBasicAuthUsers(%s)[%q] = %q, want %q", path, user, users[user], hash)
+			}
+		}
+	})
+
+	t.Run("malformed entry", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.htpasswd")
+		if err := os.WriteFile(path, []byte("not-a-valid-line\n"), 0600); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		if _, err := loadBasicAuthUsers(path); err == nil {
+			t.Error("loadBasicAuthUsers on a malformed entry returned nil error")
+		}
+	})
+}
+
+// generateSelfSignedCert writes a throwaway self-signed cert/key pair (and
+// returns the cert in PEM form for use as a client CA) to dir, for
+// exercising configureTLS without a real certificate on disk.
+func generateSelfSignedCert(t *testing.T, dir, name string) (certPath, keyPath string, certPEM []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Unix(1700000000, 0),
+		NotAfter:     time.Unix(1700000000, 0).Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	certPath = filepath.Join(dir, name+"-cert.pem")
+	keyPath = filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("failed to write cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certPath, keyPath, certPEM
+}
+
+func TestConfigureTLS(t *testing.T) {
+	t.Run("no TLS env vars set", func(t *testing.T) {
+		t.Setenv("METRICS_TLS_CERT", "")
+		t.Setenv("METRICS_TLS_KEY", "")
+		t.Setenv("METRICS_CLIENT_CA", "")
+		cfg, err := configureTLS()
+		if err != nil || cfg != nil {
+			t.Errorf("configureTLS() = %v, %v, want nil, nil", cfg, err)
+		}
+	})
+
+	t.Run("only cert set", func(t *testing.T) {
+		dir := t.TempDir()
+		certPath, _, _ := generateSelfSignedCert(t, dir, "server")
+		t.Setenv("METRICS_TLS_CERT", certPath)
+		t.Setenv("METRICS_TLS_KEY", "")
+		t.Setenv("METRICS_CLIENT_CA", "")
+		if _, err := configureTLS(); err == nil {
+			t.Error("configureTLS with only METRICS_TLS_CERT set returned nil error")
+		}
+	})
+
+	t.Run("cert and key set", func(t *testing.T) {
+		dir := t.TempDir()
+		certPath, keyPath, _ := generateSelfSignedCert(t, dir, "server")
+		t.Setenv("METRICS_TLS_CERT", certPath)
+		t.Setenv("METRICS_TLS_KEY", keyPath)
+		t.Setenv("METRICS_CLIENT_CA", "")
+		cfg, err := configureTLS()
+		if err != nil {
+			t.Fatalf("configureTLS() returned error: %v", err)
+		}
+		if cfg == nil || len(cfg.Certificates) != 1 {
+			t.Fatalf("configureTLS() = %v, want a config with one certificate", cfg)
+		}
+		if cfg.ClientAuth != tls.NoClientCert {
+			t.Errorf("configureTLS() ClientAuth = %v, want NoClientCert when METRICS_CLIENT_CA is unset", cfg.ClientAuth)
+		}
+	})
+
+	t.Run("mTLS with client CA", func(t *testing.T) {
+		dir := t.TempDir()
+		certPath, keyPath, _ := generateSelfSignedCert(t, dir, "server")
+		_, _, caPEM := generateSelfSignedCert(t, dir, "client-ca")
+		caPath := filepath.Join(dir, "ca.pem")
+		if err := os.WriteFile(caPath, caPEM, 0600); err != nil {
+			t.Fatalf("failed to write CA: %v", err)
+		}
+		t.Setenv("METRICS_TLS_CERT", certPath)
+		t.Setenv("METRICS_TLS_KEY", keyPath)
+		t.Setenv("METRICS_CLIENT_CA", caPath)
+		cfg, err := configureTLS()
+		if err != nil {
+			t.Fatalf("configureTLS() returned error: %v", err)
+		}
+		if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+			t.Errorf("configureTLS() ClientAuth = %v, want RequireAndVerifyClientCert", cfg.ClientAuth)
+		}
+		if cfg.ClientCAs == nil {
+			t.Error("configureTLS() ClientCAs = nil, want a populated pool")
+		}
+	})
+}
+
+func TestVplcAccessCredentialProvider(t *testing.T) {
+	cases := []struct {
+		name    string
+		access  VplcAccess
+		want    CredentialProvider
+		wantErr bool
+	}{
+		{
+			name:   "empty source defaults to inline",
+			access: VplcAccess{Name: "a", UserName: "u", Password: "p"},
+			want:   inlineCredentialProvider{user: "u", pass: "p"},
+		},
+		{
+			name:   "explicit inline",
+			access: VplcAccess{Name: "a", CredentialSource: "inline", UserName: "u", Password: "p"},
+			want:   inlineCredentialProvider{user: "u", pass: "p"},
+		},
+		{
+			name:   "env",
+			access: VplcAccess{Name: "a", CredentialSource: "env", CredentialRef: "USER_VAR:PASS_VAR"},
+			want:   envCredentialProvider{ref: "USER_VAR:PASS_VAR"},
+		},
+		{
+			name:   "file",
+			access: VplcAccess{Name: "a", CredentialSource: "file", CredentialRef: "/etc/secret"},
+			want:   fileCredentialProvider{path: "/etc/secret"},
+		},
+		{
+			name:   "vault",
+			access: VplcAccess{Name: "a", CredentialSource: "vault", CredentialRef: "secret/data/vplc"},
+			want:   vaultCredentialProvider{path: "secret/data/vplc"},
+		},
+		{
+			name:   "k8s-secret",
+			access: VplcAccess{Name: "a", CredentialSource: "k8s-secret", CredentialRef: "ns/name"},
+			want:   k8sSecretCredentialProvider{ref: "ns/name"},
+		},
+		{
+			name:    "unknown source",
+			access:  VplcAccess{Name: "a", CredentialSource: "bogus"},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.access.credentialProvider()
+			if (err != nil) != c.wantErr {
+				t.Fatalf("credentialProvider() error = %v, wantErr %v", err, c.wantErr)
+			}
+			if c.wantErr {
+				return
+			}
+			if got != c.want {
+				t.Errorf("credentialProvider() = %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestInlineCredentialProvider(t *testing.T) {
+	p := inlineCredentialProvider{user: "alice", pass: "hunter2"}
+	user, pass, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get() returned error: %v", err)
+	}
+	if user != "alice" || pass != "hunter2" {
+		t.Errorf("Get() = (%q, %q), want (\"alice\", \"hunter2\")", user, pass)
+	}
+}
+
+func TestEnvCredentialProvider(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		t.Setenv("TEST_USER_VAR", "alice")
+		t.Setenv("TEST_PASS_VAR", "hunter2")
+		p := envCredentialProvider{ref: "TEST_USER_VAR:TEST_PASS_VAR"}
+		user, pass, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatalf("Get() returned error: %v", err)
+		}
+		if user != "alice" || pass != "hunter2" {
+			t.Errorf("Get() = (%q, %q), want (\"alice\", \"hunter2\")", user, pass)
+		}
+	})
+
+	t.Run("malformed ref", func(t *testing.T) {
+		p := envCredentialProvider{ref: "NOT_A_PAIR"}
+		if _, _, err := p.Get(context.Background()); err == nil {
+			t.Error("Get() with a malformed ref returned nil error")
+		}
+	})
+
+	t.Run("missing env vars", func(t *testing.T) {
+		p := envCredentialProvider{ref: "DOES_NOT_EXIST_USER:DOES_NOT_EXIST_PASS"}
+		if _, _, err := p.Get(context.Background()); err == nil {
+			t.Error("Get() with unset env vars returned nil error")
+		}
+	})
+}
+
+func TestFileCredentialProvider(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("success", func(t *testing.T) {
+		path := filepath.Join(dir, "good")
+		if err := os.WriteFile(path, []byte("alice:hunter2"), 0600); err != nil {
+			t.Fatalf("failed to write credential file: %v", err)
+		}
+		p := fileCredentialProvider{path: path}
+		user, pass, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatalf("Get() returned error: %v", err)
+		}
+		if user != "alice" || pass != "hunter2" {
+			t.Errorf("Get() = (%q, %q), want (\"alice\", \"hunter2\")", user, pass)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		p := fileCredentialProvider{path: filepath.Join(dir, "does-not-exist")}
+		if _, _, err := p.Get(context.Background()); err == nil {
+			t.Error("Get() with a missing file returned nil error")
+		}
+	})
+
+	t.Run("malformed contents", func(t *testing.T) {
+		path := filepath.Join(dir, "malformed")
+		if err := os.WriteFile(path, []byte("no-colon-here"), 0600); err != nil {
+			t.Fatalf("failed to write credential file: %v", err)
+		}
+		p := fileCredentialProvider{path: path}
+		if _, _, err := p.Get(context.Background()); err == nil {
+			t.Error("Get() with malformed \"user:pass\" contents returned nil error")
+		}
+	})
+
+	t.Run("world-readable rejected", func(t *testing.T) {
+		path := filepath.Join(dir, "world-readable")
+		if err := os.WriteFile(path, []byte("alice:hunter2"), 0644); err != nil {
+			t.Fatalf("failed to write credential file: %v", err)
+		}
+		if err := os.Chmod(path, 0644); err != nil {
+			t.Fatalf("failed to chmod test file: %v", err)
+		}
+		p := fileCredentialProvider{path: path}
+		if _, _, err := p.Get(context.Background()); err == nil {
+			t.Error("Get() on a world-readable credential file returned nil error")
+		}
+	})
+}